@@ -0,0 +1,226 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package bpfmanagent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// errContainerNotRunning is returned by ContainerStatus for a container that
+// exists but is not currently running, so callers can skip it instead of
+// mistaking a stale, reused PID for the container's own.
+var errContainerNotRunning = errors.New("container is not running")
+
+// defaultRuntimeEndpoints are the CRI sockets probed, in order, when no
+// socket is explicitly configured.
+var defaultRuntimeEndpoints = []string{
+	"/run/containerd/containerd.sock",
+	"/var/run/crio/crio.sock",
+}
+
+// criDialTimeout bounds how long we wait for the CRI socket to accept a
+// connection before giving up.
+const criDialTimeout = 5 * time.Second
+
+// PodSandbox is the subset of a CRI PodSandbox this package cares about.
+type PodSandbox struct {
+	ID   string
+	Name string
+}
+
+// Container is the subset of a CRI Container this package cares about.
+type Container struct {
+	ID           string
+	Name         string
+	PodSandboxID string
+}
+
+// ContainerStatusInfo is the subset of a CRI ContainerStatus this package
+// cares about.
+type ContainerStatusInfo struct {
+	PID int64
+}
+
+// ContainerRuntime is the subset of the CRI v1 RuntimeService that
+// getContainerInfo needs. Production code talks to the node's container
+// runtime over gRPC via NewContainerRuntime; tests substitute a fake.
+type ContainerRuntime interface {
+	// ListPodSandboxes returns the pod sandboxes known to the runtime. If
+	// nameFilter is non-empty, only sandboxes with that exact name are
+	// returned.
+	ListPodSandboxes(ctx context.Context, nameFilter string) ([]PodSandbox, error)
+	// ListContainers returns the running containers belonging to
+	// podSandboxID; exited containers are not returned.
+	ListContainers(ctx context.Context, podSandboxID string) ([]Container, error)
+	// ContainerStatus returns status info, including the host PID, for the
+	// given container.
+	ContainerStatus(ctx context.Context, containerID string) (*ContainerStatusInfo, error)
+	// Close releases the underlying connection to the runtime.
+	Close() error
+}
+
+// criRuntime is a ContainerRuntime backed by a CRI v1 RuntimeService gRPC
+// connection to the node's container runtime socket.
+type criRuntime struct {
+	conn   *grpc.ClientConn
+	client criapi.RuntimeServiceClient
+}
+
+// NewContainerRuntime dials the node's CRI socket and returns a
+// ContainerRuntime backed by it. If endpoint is empty, the well-known
+// containerd and CRI-O sockets are probed in turn and the first one found on
+// disk is used.
+func NewContainerRuntime(ctx context.Context, endpoint string) (ContainerRuntime, error) {
+	endpoint, err := resolveRuntimeEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, criDialTimeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(dialCtx, "unix://"+endpoint,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dialing CRI socket %s: %w", endpoint, err)
+	}
+
+	return &criRuntime{
+		conn:   conn,
+		client: criapi.NewRuntimeServiceClient(conn),
+	}, nil
+}
+
+// resolveRuntimeEndpoint returns endpoint unchanged if it is set, otherwise
+// it probes defaultRuntimeEndpoints and returns the first one that exists on
+// disk.
+func resolveRuntimeEndpoint(endpoint string) (string, error) {
+	if endpoint != "" {
+		return endpoint, nil
+	}
+
+	for _, candidate := range defaultRuntimeEndpoints {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no container runtime socket found, tried %v", defaultRuntimeEndpoints)
+}
+
+func (c *criRuntime) ListPodSandboxes(ctx context.Context, nameFilter string) ([]PodSandbox, error) {
+	resp, err := c.client.ListPodSandbox(ctx, &criapi.ListPodSandboxRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("listing pod sandboxes: %w", err)
+	}
+
+	sandboxes := make([]PodSandbox, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		name := item.GetMetadata().GetName()
+		if nameFilter != "" && name != nameFilter {
+			continue
+		}
+		sandboxes = append(sandboxes, PodSandbox{ID: item.Id, Name: name})
+	}
+
+	return sandboxes, nil
+}
+
+func (c *criRuntime) ListContainers(ctx context.Context, podSandboxID string) ([]Container, error) {
+	// Match crictl's default "running only" behavior (crictl ps without
+	// -a). containerd and CRI-O otherwise keep exited container records
+	// around for a sandbox until GC, so a restarted/crash-looping
+	// container would yield both its stale exited record and its current
+	// one under the same name.
+	resp, err := c.client.ListContainers(ctx, &criapi.ListContainersRequest{
+		Filter: &criapi.ContainerFilter{
+			PodSandboxId: podSandboxID,
+			State:        &criapi.ContainerStateValue{State: criapi.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers for sandbox %s: %w", podSandboxID, err)
+	}
+
+	containers := make([]Container, 0, len(resp.Containers))
+	for _, item := range resp.Containers {
+		containers = append(containers, Container{
+			ID:           item.Id,
+			Name:         item.GetMetadata().GetName(),
+			PodSandboxID: item.PodSandboxId,
+		})
+	}
+
+	return containers, nil
+}
+
+func (c *criRuntime) ContainerStatus(ctx context.Context, containerID string) (*ContainerStatusInfo, error) {
+	resp, err := c.client.ContainerStatus(ctx, &criapi.ContainerStatusRequest{
+		ContainerId: containerID,
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("getting container status for %s: %w", containerID, err)
+	}
+
+	// The container may have exited between ListContainers' State filter
+	// and this call; re-check here rather than trusting a PID that the
+	// kernel could already have handed to an unrelated process.
+	if resp.Status == nil || resp.Status.State != criapi.ContainerState_CONTAINER_RUNNING {
+		return nil, errContainerNotRunning
+	}
+
+	pid, err := containerPidFromVerboseInfo(resp.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContainerStatusInfo{PID: pid}, nil
+}
+
+func (c *criRuntime) Close() error {
+	return c.conn.Close()
+}
+
+// containerPidFromVerboseInfo extracts the host PID from the "info" map
+// returned by a verbose ContainerStatus call. Both containerd and CRI-O
+// populate info["info"] with a JSON blob containing a top-level "pid" field.
+func containerPidFromVerboseInfo(info map[string]string) (int64, error) {
+	raw, ok := info["info"]
+	if !ok {
+		return 0, fmt.Errorf("container status response did not include verbose info")
+	}
+
+	var parsed struct {
+		Pid int64 `json:"pid"`
+	}
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return 0, fmt.Errorf("parsing verbose container info: %w", err)
+	}
+
+	return parsed.Pid, nil
+}
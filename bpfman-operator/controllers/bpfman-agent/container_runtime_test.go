@@ -0,0 +1,486 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package bpfmanagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	criapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+
+	"github.com/bpfman/bpfman/bpfman-operator/internal"
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+)
+
+func testLogger(t *testing.T) logr.Logger {
+	t.Helper()
+	return testr.New(t)
+}
+
+// fakeCRIServer is a minimal in-memory CRI v1 RuntimeService used to test
+// criRuntime without a real container runtime socket.
+type fakeCRIServer struct {
+	criapi.UnimplementedRuntimeServiceServer
+
+	sandboxes  []*criapi.PodSandbox
+	containers []*criapi.Container
+	pids       map[string]int64
+	// states overrides a container's state as reported by ListContainers'
+	// State filter, by ID; containers not present here default to
+	// CONTAINER_RUNNING.
+	states map[string]criapi.ContainerState
+	// statusStates overrides a container's state as reported by
+	// ContainerStatus, by ID, independently of states. This lets a test
+	// simulate a container that is still listed as running but has exited
+	// by the time ContainerStatus is called. Containers not present here
+	// fall back to states (and then to CONTAINER_RUNNING).
+	statusStates map[string]criapi.ContainerState
+}
+
+func (f *fakeCRIServer) listStateOf(id string) criapi.ContainerState {
+	if state, ok := f.states[id]; ok {
+		return state
+	}
+	return criapi.ContainerState_CONTAINER_RUNNING
+}
+
+func (f *fakeCRIServer) statusStateOf(id string) criapi.ContainerState {
+	if state, ok := f.statusStates[id]; ok {
+		return state
+	}
+	return f.listStateOf(id)
+}
+
+func (f *fakeCRIServer) ListPodSandbox(_ context.Context, _ *criapi.ListPodSandboxRequest) (*criapi.ListPodSandboxResponse, error) {
+	return &criapi.ListPodSandboxResponse{Items: f.sandboxes}, nil
+}
+
+func (f *fakeCRIServer) ListContainers(_ context.Context, req *criapi.ListContainersRequest) (*criapi.ListContainersResponse, error) {
+	var matched []*criapi.Container
+	for _, c := range f.containers {
+		if req.Filter != nil && req.Filter.PodSandboxId != "" && c.PodSandboxId != req.Filter.PodSandboxId {
+			continue
+		}
+		if req.Filter != nil && req.Filter.State != nil && f.listStateOf(c.Id) != req.Filter.State.State {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	return &criapi.ListContainersResponse{Containers: matched}, nil
+}
+
+func (f *fakeCRIServer) ContainerStatus(_ context.Context, req *criapi.ContainerStatusRequest) (*criapi.ContainerStatusResponse, error) {
+	pid, ok := f.pids[req.ContainerId]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", req.ContainerId)
+	}
+
+	info, err := json.Marshal(struct {
+		Pid int64 `json:"pid"`
+	}{Pid: pid})
+	if err != nil {
+		return nil, err
+	}
+
+	return &criapi.ContainerStatusResponse{
+		Status: &criapi.ContainerStatus{State: f.statusStateOf(req.ContainerId)},
+		Info:   map[string]string{"info": string(info)},
+	}, nil
+}
+
+// dialFakeCRIRuntime starts srv on an in-memory listener and returns a
+// criRuntime connected to it.
+func dialFakeCRIRuntime(t *testing.T, srv *fakeCRIServer) *criRuntime {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	criapi.RegisterRuntimeServiceServer(grpcServer, srv)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dialing fake CRI server: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return &criRuntime{conn: conn, client: criapi.NewRuntimeServiceClient(conn)}
+}
+
+func TestGetContainerInfoWithFakeCRIServer(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+			{Id: "container-2", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "sidecar"}},
+		},
+		pids: map[string]int64{
+			"container-1": 4242,
+			"container-2": 4343,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "my-pod"}},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, nil, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	if len(*containers) != 2 {
+		t.Fatalf("expected 2 containers, got %d", len(*containers))
+	}
+
+	got := map[string]int64{}
+	for _, c := range *containers {
+		got[c.containerName] = c.pid
+	}
+
+	if got["app"] != 4242 || got["sidecar"] != 4343 {
+		t.Fatalf("unexpected container info: %+v", got)
+	}
+}
+
+func TestGetContainerInfoSkipsStaleExitedContainers(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			// A stale, already-exited record for a restarted/crash-looping
+			// "app" container, alongside its current running one. Both
+			// share a name, as containerd and CRI-O keep exited container
+			// records around for a sandbox until GC.
+			{Id: "container-1-old", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+		},
+		pids: map[string]int64{
+			"container-1-old": 9999, // may already have been reused by an unrelated process
+			"container-1":     4242,
+		},
+		states: map[string]criapi.ContainerState{
+			"container-1-old": criapi.ContainerState_CONTAINER_EXITED,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "my-pod"}},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, nil, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	if len(*containers) != 1 || (*containers)[0].pid != 4242 {
+		t.Fatalf("expected only the running app container, got %+v", *containers)
+	}
+}
+
+func TestGetContainerInfoFiltersByContainerName(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+			{Id: "container-2", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "sidecar"}},
+		},
+		pids: map[string]int64{
+			"container-1": 4242,
+			"container-2": 4343,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "my-pod"}},
+		},
+	}
+
+	names := []string{"app"}
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, &names, nil, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	if len(*containers) != 1 || (*containers)[0].containerName != "app" {
+		t.Fatalf("expected only the app container, got %+v", *containers)
+	}
+}
+
+func TestGetContainerInfoPodNotFoundIsAWarningNotAFatalError(t *testing.T) {
+	srv := &fakeCRIServer{}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "missing-pod"}},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, nil, testLogger(t))
+	if len(*containers) != 0 {
+		t.Fatalf("expected no containers, got %+v", *containers)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning for the missing pod, got %v", warnings)
+	}
+}
+
+func TestGetContainerInfoFiltersByContainerType(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+			{Id: "container-2", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "setup"}},
+		},
+		pids: map[string]int64{
+			"container-1": 4242,
+			"container-2": 4343,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pod"},
+				Spec: v1.PodSpec{
+					Containers:     []v1.Container{{Name: "app"}},
+					InitContainers: []v1.Container{{Name: "setup"}},
+				},
+			},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, []string{ContainerTypeInit}, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	if len(*containers) != 1 || (*containers)[0].containerName != "setup" {
+		t.Fatalf("expected only the init container, got %+v", *containers)
+	}
+}
+
+func TestGetContainerInfoSkipsExitedInitContainer(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			// An ordinary (non-restartable) init container: by the time
+			// the pod is Running, it has already exited.
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "setup"}},
+		},
+		pids: map[string]int64{"container-1": 4242},
+		states: map[string]criapi.ContainerState{
+			"container-1": criapi.ContainerState_CONTAINER_EXITED,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pod"},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "setup"}},
+				},
+			},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, []string{ContainerTypeInit}, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings for an already-exited init container, got %v", warnings)
+	}
+	if len(*containers) != 0 {
+		t.Fatalf("expected the exited init container to be skipped, not returned, got %+v", *containers)
+	}
+}
+
+func TestGetContainerInfoWarnsOnAppContainerRaceToExited(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			// Listed as running, but exits before ContainerStatus is
+			// called. Unlike an ordinary init container's exit, this is
+			// unexpected for an app container and should surface as a
+			// warning rather than being silently dropped.
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+		},
+		pids: map[string]int64{"container-1": 4242},
+		statusStates: map[string]criapi.ContainerState{
+			"container-1": criapi.ContainerState_CONTAINER_EXITED,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{ObjectMeta: metav1.ObjectMeta{Name: "my-pod"}},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, nil, testLogger(t))
+	if len(*containers) != 0 {
+		t.Fatalf("expected the container to be skipped, got %+v", *containers)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected one warning for the app container racing to exited, got %v", warnings)
+	}
+}
+
+func TestGetContainerInfoSkipsInitContainerRaceToExitedWithoutWarning(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+		},
+		containers: []*criapi.Container{
+			// Listed as running, but has exited by the time
+			// ContainerStatus is called, same race as above, except this
+			// is an init container, so it's the expected case and should
+			// not warn.
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "setup"}},
+		},
+		pids: map[string]int64{"container-1": 4242},
+		statusStates: map[string]criapi.ContainerState{
+			"container-1": criapi.ContainerState_CONTAINER_EXITED,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "my-pod"},
+				Spec: v1.PodSpec{
+					InitContainers: []v1.Container{{Name: "setup"}},
+				},
+			},
+		},
+	}
+
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, nil, []string{ContainerTypeInit}, testLogger(t))
+	if len(*containers) != 0 {
+		t.Fatalf("expected the init container to be skipped, got %+v", *containers)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings for an init container racing to exited, got %v", warnings)
+	}
+}
+
+func TestGetContainerInfoUprobeAnnotationOverridesSelector(t *testing.T) {
+	srv := &fakeCRIServer{
+		sandboxes: []*criapi.PodSandbox{
+			{Id: "sandbox-1", Metadata: &criapi.PodSandboxMetadata{Name: "my-pod"}},
+			{Id: "sandbox-2", Metadata: &criapi.PodSandboxMetadata{Name: "excluded-pod"}},
+		},
+		containers: []*criapi.Container{
+			{Id: "container-1", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+			{Id: "container-2", PodSandboxId: "sandbox-1", Metadata: &criapi.ContainerMetadata{Name: "sidecar"}},
+			{Id: "container-3", PodSandboxId: "sandbox-2", Metadata: &criapi.ContainerMetadata{Name: "app"}},
+		},
+		pids: map[string]int64{
+			"container-1": 4242,
+			"container-2": 4343,
+			"container-3": 4444,
+		},
+	}
+
+	runtime := dialFakeCRIRuntime(t, srv)
+	defer runtime.Close()
+
+	podList := &v1.PodList{
+		Items: []v1.Pod{
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "my-pod",
+					Annotations: map[string]string{internal.UprobeAnnotation: "containers=sidecar"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "excluded-pod",
+					Annotations: map[string]string{internal.UprobeAnnotation: "disabled"},
+				},
+			},
+		},
+	}
+
+	// The ContainerSelector would otherwise only match "app", but the
+	// pod-level annotation narrows "my-pod" to "sidecar" and excludes
+	// "excluded-pod" entirely.
+	names := []string{"app"}
+	containers, warnings := getContainerInfo(context.Background(), runtime, podList, &names, nil, testLogger(t))
+	if len(warnings) != 0 {
+		t.Fatalf("expected no warnings, got %v", warnings)
+	}
+
+	if len(*containers) != 1 || (*containers)[0].podName != "my-pod" || (*containers)[0].containerName != "sidecar" {
+		t.Fatalf("expected only my-pod's sidecar container, got %+v", *containers)
+	}
+}
@@ -17,159 +17,252 @@ package bpfmanagent
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
 	"slices"
-	"strconv"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 
 	bpfmaniov1alpha1 "github.com/bpfman/bpfman/bpfman-operator/apis/v1alpha1"
 	"github.com/bpfman/bpfman/bpfman-operator/internal"
-	"github.com/buger/jsonparser"
 	"github.com/go-logr/logr"
 )
 
-// getPodsForNode returns a list of pods on the given node that match the given
-// container selector.
-func getPodsForNode(ctx context.Context, clientset kubernetes.Interface,
-	containerSelector *bpfmaniov1alpha1.ContainerSelector, nodeName string) (*v1.PodList, error) {
+// getPodsForNode returns the pods that match the given container selector,
+// served from podInformer's local cache rather than a List call to the API
+// server. podInformer is already scoped to a single node.
+func getPodsForNode(podInformer *podInformer, containerSelector *bpfmaniov1alpha1.ContainerSelector) (*v1.PodList, error) {
+	return podInformer.Pods(containerSelector)
+}
 
-	selectorString := metav1.FormatLabelSelector(&containerSelector.Pods)
+// Container kinds a ContainerSelector's ContainerType can target. Kind
+// defaults to ContainerTypeApp, matching the selector's historical,
+// app-containers-only behavior.
+const (
+	ContainerTypeApp       = "app"
+	ContainerTypeInit      = "init"
+	ContainerTypeEphemeral = "ephemeral"
+)
 
-	if selectorString == "<error>" {
-		return nil, fmt.Errorf("error parsing selector: %v", selectorString)
-	}
+type containerInfo struct {
+	podName       string
+	containerName string
+	containerType string
+	pid           int64
+}
 
-	listOptions := metav1.ListOptions{
-		FieldSelector: "spec.nodeName=" + nodeName,
-	}
+// The bpfman.io/uprobe annotation lets a workload opt in or out of uprobe
+// attachment on a per-pod or per-container basis, overriding whatever a
+// cluster-wide ContainerSelector would otherwise match. It is read from the
+// pod; this borrows the same per-container suffix convention used elsewhere
+// in the container ecosystem for annotations that alter runtime behavior per
+// container (e.g. io.containers.sdnotify).
+//
+//   - Set on the pod as "bpfman.io/uprobe: disabled" to exempt every
+//     container in the pod.
+//   - Set on the pod as "bpfman.io/uprobe: containers=foo,bar" to narrow
+//     attachment to the named containers, in place of the ContainerSelector's
+//     container names; the selector's container types still apply.
+//   - Set per-container as "bpfman.io/uprobe.<container>: disabled" to
+//     exempt just that container.
+//
+// If every pod and container a ContainerSelector would otherwise have
+// matched on this node is excluded this way, the reconciler sets the
+// internal.UprobeNoContainersOnNode annotation exactly as it would if the
+// selector itself had matched nothing, so opting out via annotation looks
+// the same to callers as having no matching workloads at all.
+const (
+	uprobeAnnotationDisabled         = "disabled"
+	uprobeAnnotationContainersPrefix = "containers="
+)
 
-	if selectorString != "<none>" {
-		listOptions.LabelSelector = selectorString
-	}
+// podUprobeDirective is the result of evaluating a pod's bpfman.io/uprobe
+// annotation. A zero-value directive means the annotation wasn't set, or
+// didn't match a recognized form, and the ContainerSelector applies as-is.
+type podUprobeDirective struct {
+	disabled   bool
+	containers []string
+}
 
-	podList, err := clientset.CoreV1().Pods(containerSelector.Namespace).List(ctx, listOptions)
-	if err != nil {
-		return nil, fmt.Errorf("error getting pod list: %v", err)
+// parseUprobeAnnotation interprets the value of a pod-level bpfman.io/uprobe
+// annotation.
+func parseUprobeAnnotation(value string) podUprobeDirective {
+	switch {
+	case value == uprobeAnnotationDisabled:
+		return podUprobeDirective{disabled: true}
+	case strings.HasPrefix(value, uprobeAnnotationContainersPrefix):
+		names := strings.Split(strings.TrimPrefix(value, uprobeAnnotationContainersPrefix), ",")
+		return podUprobeDirective{containers: names}
+	default:
+		return podUprobeDirective{}
 	}
-
-	return podList, nil
 }
 
-type containerInfo struct {
-	podName       string
-	containerName string
-	pid           int64
+// containerUprobeDisabled reports whether containerName was individually
+// exempted via a "bpfman.io/uprobe.<containerName>: disabled" annotation on
+// pod.
+func containerUprobeDisabled(podAnnotations map[string]string, containerName string) bool {
+	return podAnnotations[internal.UprobeAnnotation+"."+containerName] == uprobeAnnotationDisabled
 }
 
-// getContainerInfo returns a list of containerInfo for the given pod list and container names.
-func getContainerInfo(podList *v1.PodList, containerNames *[]string, logger logr.Logger) (*[]containerInfo, error) {
+// containerKindsForPod maps each container name declared on pod's spec to
+// the kind of container it is, so discovery can tell init and ephemeral
+// containers apart from the app containers a bare ContainerSelector
+// defaults to.
+func containerKindsForPod(pod *v1.Pod) map[string]string {
+	kinds := make(map[string]string, len(pod.Spec.Containers)+len(pod.Spec.InitContainers)+len(pod.Spec.EphemeralContainers))
+
+	for _, c := range pod.Spec.Containers {
+		kinds[c.Name] = ContainerTypeApp
+	}
+	for _, c := range pod.Spec.InitContainers {
+		kinds[c.Name] = ContainerTypeInit
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		kinds[c.Name] = ContainerTypeEphemeral
+	}
+
+	return kinds
+}
 
-	crictl := "/usr/local/bin/crictl"
+// getContainerInfo returns a list of containerInfo for the given pod list,
+// container names, and container kinds (app/init/ephemeral), querying the
+// node's container runtime directly over its CRI gRPC socket. A container
+// runtime tracks every container belonging to a pod's sandbox regardless of
+// kind, so init and ephemeral containers are discovered the same way as app
+// containers; containerTypes decides which kinds are kept. An empty
+// containerTypes defaults to ContainerTypeApp only, preserving the
+// historical behavior of a ContainerSelector that doesn't opt in. A failure
+// specific to a single pod (e.g. it was deleted between listing and
+// querying the runtime) is recorded as a warning and that pod is skipped,
+// rather than aborting discovery for the rest of the node.
+func getContainerInfo(ctx context.Context, runtime ContainerRuntime, podList *v1.PodList, containerNames *[]string, containerTypes []string, logger logr.Logger) (*[]containerInfo, []string) {
+
+	if len(containerTypes) == 0 {
+		containerTypes = []string{ContainerTypeApp}
+	}
 
 	containers := []containerInfo{}
+	var warnings []string
 
 	for i, pod := range podList.Items {
 		logger.V(1).Info("Pod", "index", i, "Name", pod.Name, "Namespace", pod.Namespace, "NodeName", pod.Spec.NodeName)
 
 		// Find the unique Pod ID of the given pod.
-		cmd := exec.Command(crictl, "pods", "--name", pod.Name, "-o", "json")
-		podInfo, err := cmd.Output()
+		sandboxes, err := runtime.ListPodSandboxes(ctx, pod.Name)
 		if err != nil {
 			logger.Info("Failed to get pod info", "error", err)
-			return nil, err
+			warnings = append(warnings, fmt.Sprintf("pod %s: failed to get pod info: %v", pod.Name, err))
+			continue
 		}
 
-		// The crictl --name option works like a grep on the names of pods.
-		// Since we are using the unique name of the pod generated by k8s, we
-		// will most likely only get one pod. Though very unlikely, it is
-		// technically possible that this unique name is a substring of another
-		// pod name. If that happens, we would get multiple pods, so we handle
-		// that possibility with the following for loop.
+		// ListPodSandboxes already filters on the exact pod name, so we
+		// will most likely get exactly one sandbox; the loop below still
+		// confirms the name before taking a sandbox's ID.
 		var podId string
 		podFound := false
-		for podIndex := 0; ; podIndex++ {
-			indexString := "[" + strconv.Itoa(podIndex) + "]"
-			podId, err = jsonparser.GetString(podInfo, "items", indexString, "id")
-			if err != nil {
-				// We hit the end of the list of pods and didn't find it.  This
-				// should only happen if the pod was deleted between the time we
-				// got the list of pods and the time we got the info about the
-				// pod.
-				break
-			}
-			podName, err := jsonparser.GetString(podInfo, "items", indexString, "metadata", "name")
-			if err != nil {
-				// We shouldn't get an error here if we didn't get an error
-				// above, but just in case...
-				logger.Error(err, "Error getting pod name")
-				break
-			}
-
-			if podName == pod.Name {
+		for _, sandbox := range sandboxes {
+			if sandbox.Name == pod.Name {
+				podId = sandbox.ID
 				podFound = true
 				break
 			}
 		}
 
 		if !podFound {
-			return nil, fmt.Errorf("pod %s not found in crictl pod list", pod.Name)
+			// This should only happen if the pod was deleted between the
+			// time we got the list of pods and the time we queried the
+			// runtime for its sandbox.
+			warnings = append(warnings, fmt.Sprintf("pod %s: not found in container runtime's pod sandbox list, likely deleted mid-reconcile", pod.Name))
+			continue
 		}
 
-		logger.V(1).Info("podFound", "podId", podId, "err", err)
+		logger.V(1).Info("podFound", "podId", podId)
+
+		// The bpfman.io/uprobe annotation lets this pod opt out of uprobe
+		// attachment entirely, or narrow it to an explicit subset of
+		// containers, overriding the ContainerSelector's container names
+		// below.
+		podDirective := parseUprobeAnnotation(pod.Annotations[internal.UprobeAnnotation])
+		if podDirective.disabled {
+			logger.V(1).Info("pod opted out of uprobe attachment via annotation", "pod", pod.Name)
+			continue
+		}
 
 		// Get info about the containers in the pod so we can get their unique IDs.
-		cmd = exec.Command(crictl, "ps", "--pod", podId, "-o", "json")
-		containerData, err := cmd.Output()
+		podContainers, err := runtime.ListContainers(ctx, podId)
 		if err != nil {
 			logger.Info("Failed to get container info", "error", err)
-			return nil, err
+			warnings = append(warnings, fmt.Sprintf("pod %s: failed to get container info: %v", pod.Name, err))
+			continue
 		}
 
-		// For each container in the pod...
-		for containerIndex := 0; ; containerIndex++ {
-
-			indexString := "[" + strconv.Itoa(containerIndex) + "]"
+		kinds := containerKindsForPod(&pod)
 
-			// Make sure the container name is in the list of containers we want.
-			containerName, err := jsonparser.GetString(containerData, "containers", indexString, "metadata", "name")
-			if err != nil {
-				break
+		// For each container in the pod...
+		for _, c := range podContainers {
+			// Only keep containers of a kind the selector opted into.
+			kind, ok := kinds[c.Name]
+			if !ok {
+				// Not declared on the pod's spec; most likely a sandbox
+				// infra container the runtime surfaces alongside the real
+				// ones. Treat it as an app container so the historical
+				// behavior (match-by-name against app containers) is
+				// unaffected.
+				kind = ContainerTypeApp
+			}
+			if !slices.Contains(containerTypes, kind) {
+				continue
 			}
 
-			if containerNames != nil &&
-				len(*containerNames) > 0 &&
-				!slices.Contains((*containerNames), containerName) {
+			if containerUprobeDisabled(pod.Annotations, c.Name) {
+				logger.V(1).Info("container opted out of uprobe attachment via annotation", "pod", pod.Name, "container", c.Name)
 				continue
 			}
 
-			// If it is in the list, get the container ID.
-			containerId, err := jsonparser.GetString(containerData, "containers", indexString, "id")
-			if err != nil {
-				break
+			// A pod-level "containers=" annotation overrides the
+			// ContainerSelector's own container name allowlist.
+			if podDirective.containers != nil {
+				if !slices.Contains(podDirective.containers, c.Name) {
+					continue
+				}
+			} else if containerNames != nil &&
+				len(*containerNames) > 0 &&
+				!slices.Contains((*containerNames), c.Name) {
+				continue
 			}
 
 			// Now use the container ID to get more info about the container so
 			// we can get the PID.
-			cmd = exec.Command(crictl, "inspect", "-o", "json", containerId)
-			containerData, err := cmd.Output()
+			status, err := runtime.ContainerStatus(ctx, c.ID)
 			if err != nil {
+				if errors.Is(err, errContainerNotRunning) && kind == ContainerTypeInit {
+					// Expected for an ordinary (non-restartable) init
+					// container: it has already exited by the time the
+					// pod reaches Running, so there's no live PID to
+					// uprobe. Restartable "native sidecar" init
+					// containers stay running and aren't affected. This
+					// isn't a warning; it's the normal, expected case.
+					//
+					// An app or ephemeral container reporting
+					// errContainerNotRunning here means it raced from
+					// running to exited between ListContainers and this
+					// call, which is unexpected and falls through to the
+					// warning below like any other status failure.
+					logger.V(1).Info("skipping non-running init container", "pod", pod.Name, "container", c.Name)
+					continue
+				}
 				logger.Info("Failed to get container data", "error", err)
-				continue
-			}
-			containerPid, err := jsonparser.GetInt(containerData, "info", "pid")
-			if err != nil {
-				logger.Info("Failed to get container PID", "error", err)
+				warnings = append(warnings, fmt.Sprintf("pod %s container %s: failed to get container status: %v", pod.Name, c.Name, err))
 				continue
 			}
 
 			container := containerInfo{
 				podName:       pod.Name,
-				containerName: containerName,
-				pid:           containerPid,
+				containerName: c.Name,
+				containerType: kind,
+				pid:           status.PID,
 			}
 
 			containers = append(containers, container)
@@ -177,7 +270,28 @@ func getContainerInfo(podList *v1.PodList, containerNames *[]string, logger logr
 
 	}
 
-	return &containers, nil
+	return &containers, warnings
+}
+
+// setContainerDiscoveryWarnings surfaces non-fatal per-pod warnings collected
+// during getContainerInfo on the BpfProgram, so a single racing pod deletion
+// (or similar transient failure) is visible without having aborted discovery
+// for the rest of the node.
+func setContainerDiscoveryWarnings(bpfProgram *bpfmaniov1alpha1.BpfProgram, warnings []string) {
+	if bpfProgram == nil {
+		return
+	}
+
+	if len(warnings) == 0 {
+		delete(bpfProgram.Annotations, internal.UprobeContainerWarnings)
+		return
+	}
+
+	if bpfProgram.Annotations == nil {
+		bpfProgram.Annotations = map[string]string{}
+	}
+
+	bpfProgram.Annotations[internal.UprobeContainerWarnings] = strings.Join(warnings, "; ")
 }
 
 // Check if the annotation is set to indicate that no containers on this node
@@ -0,0 +1,258 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package bpfmanagent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	bpfmaniov1alpha1 "github.com/bpfman/bpfman/bpfman-operator/apis/v1alpha1"
+	"github.com/go-logr/logr"
+)
+
+// podInformer maintains a node-scoped, locally-cached view of pods and
+// notifies registered ContainerSelectors when a matching pod starts running
+// or goes away. This lets uprobe attachment react to pod lifecycle events
+// within a second, instead of only picking up new containers on the next
+// periodic reconcile.
+//
+// The underlying informer is shared across every registered
+// ContainerSelector and is narrowed server-side only by node name; it does
+// not additionally narrow by the union of selectors' label selectors, so
+// every pod on the node ends up in the local cache and is walked against
+// pi.selectors on each add/update/delete. A single shared informer can't
+// apply a different field/label selector per registered owner, and
+// ContainerSelectors come and go at runtime, so this trades some
+// per-event CPU for a single watch per node rather than one watch per
+// BpfProgram.
+type podInformer struct {
+	nodeName string
+	logger   logr.Logger
+
+	informer cache.SharedIndexInformer
+	events   chan event.GenericEvent
+
+	mu        sync.RWMutex
+	selectors map[types.NamespacedName]*bpfmaniov1alpha1.ContainerSelector
+}
+
+// newPodInformer builds a podInformer that watches every pod scheduled to
+// nodeName, regardless of whether any registered ContainerSelector matches
+// it; see the podInformer doc comment for why selector matching happens
+// client-side instead. Call Start before using it, and Events to obtain the
+// channel to wire into a controller-runtime source.Channel for the
+// BpfProgram reconciler.
+func newPodInformer(clientset kubernetes.Interface, nodeName string, logger logr.Logger) *podInformer {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = "spec.nodeName=" + nodeName
+		}),
+	)
+
+	pi := &podInformer{
+		nodeName:  nodeName,
+		logger:    logger,
+		informer:  factory.Core().V1().Pods().Informer(),
+		events:    make(chan event.GenericEvent, 128),
+		selectors: map[types.NamespacedName]*bpfmaniov1alpha1.ContainerSelector{},
+	}
+
+	pi.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// A newly seen pod only matters once it is Running; its later
+			// phase transitions arrive through handlePodUpdate.
+			if pod, ok := obj.(*v1.Pod); ok && pod.Status.Phase != v1.PodRunning {
+				return
+			}
+			pi.handlePod(obj)
+		},
+		UpdateFunc: pi.handlePodUpdate,
+		DeleteFunc: pi.handlePod,
+	})
+
+	return pi
+}
+
+// Start begins populating the informer's cache in the background and blocks
+// until the initial sync completes or ctx is done.
+func (pi *podInformer) Start(ctx context.Context) error {
+	go pi.informer.Run(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), pi.informer.HasSynced) {
+		return fmt.Errorf("pod informer for node %s failed to sync", pi.nodeName)
+	}
+
+	return nil
+}
+
+// Events returns the channel of GenericEvents raised when a pod matching a
+// registered selector is first seen Running, changes phase (e.g. to Running,
+// Succeeded or Failed), or is removed.
+func (pi *podInformer) Events() <-chan event.GenericEvent {
+	return pi.events
+}
+
+// RegisterSelector records that owner's BpfProgram should be reconciled
+// whenever a pod matching selector changes state. Call UnregisterSelector
+// when the owning BpfProgram is deleted.
+func (pi *podInformer) RegisterSelector(owner types.NamespacedName, selector *bpfmaniov1alpha1.ContainerSelector) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+
+	pi.selectors[owner] = selector
+}
+
+// UnregisterSelector removes owner's selector so further pod changes no
+// longer trigger its reconcile.
+func (pi *podInformer) UnregisterSelector(owner types.NamespacedName) {
+	pi.mu.Lock()
+	defer pi.mu.Unlock()
+
+	delete(pi.selectors, owner)
+}
+
+// Pods returns the pods currently in the local cache that match selector,
+// without issuing a List call to the API server. Pods that have not yet been
+// scheduled (an empty Spec.NodeName, e.g. a Pending pod) are always skipped,
+// and the remainder are filtered to selector.PodPhase, which defaults to
+// Running.
+func (pi *podInformer) Pods(selector *bpfmaniov1alpha1.ContainerSelector) (*v1.PodList, error) {
+	labelSelector, err := metav1.LabelSelectorAsSelector(&selector.Pods)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing selector: %w", err)
+	}
+
+	phase := selector.PodPhase
+	if phase == "" {
+		phase = v1.PodRunning
+	}
+
+	podList := &v1.PodList{}
+	for _, obj := range pi.informer.GetStore().List() {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			continue
+		}
+
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+
+		if pod.Status.Phase != phase {
+			continue
+		}
+
+		if !podMatchesSelector(pod, selector.Namespace, labelSelector) {
+			continue
+		}
+
+		podList.Items = append(podList.Items, *pod)
+	}
+
+	return podList, nil
+}
+
+// handlePodUpdate only forwards to handlePod on an actual phase transition
+// (e.g. Pending -> Running, or Running -> Succeeded/Failed), rather than on
+// every update a pod receives (status heartbeats, resource updates, etc.),
+// most of which have no bearing on uprobe attachment.
+func (pi *podInformer) handlePodUpdate(oldObj, newObj interface{}) {
+	oldPod, ok := oldObj.(*v1.Pod)
+	if !ok {
+		pi.handlePod(newObj)
+		return
+	}
+
+	newPod, ok := newObj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	if oldPod.Status.Phase == newPod.Status.Phase {
+		return
+	}
+
+	pi.handlePod(newObj)
+}
+
+// handlePod enqueues a reconcile event for every registered owner whose
+// selector matches pod. Enqueueing is non-blocking: if Events' channel is
+// full because nothing is draining it, the event is dropped and logged
+// rather than risking a deadlock, since handlePod runs under pi.mu.RLock and
+// a blocked send here would also wedge RegisterSelector/UnregisterSelector,
+// which wait on pi.mu.Lock().
+func (pi *podInformer) handlePod(obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		pod, ok = tombstone.Obj.(*v1.Pod)
+		if !ok {
+			return
+		}
+	}
+
+	pi.mu.RLock()
+	defer pi.mu.RUnlock()
+
+	for owner, selector := range pi.selectors {
+		labelSelector, err := metav1.LabelSelectorAsSelector(&selector.Pods)
+		if err != nil {
+			pi.logger.Error(err, "error parsing selector", "owner", owner)
+			continue
+		}
+
+		if !podMatchesSelector(pod, selector.Namespace, labelSelector) {
+			continue
+		}
+
+		pi.logger.V(1).Info("pod matched container selector, enqueueing reconcile", "pod", pod.Name, "owner", owner)
+
+		ev := event.GenericEvent{
+			Object: &bpfmaniov1alpha1.BpfProgram{
+				ObjectMeta: metav1.ObjectMeta{Name: owner.Name, Namespace: owner.Namespace},
+			},
+		}
+
+		select {
+		case pi.events <- ev:
+		default:
+			pi.logger.Info("dropping pod event, event channel is full", "pod", pod.Name, "owner", owner)
+		}
+	}
+}
+
+// podMatchesSelector reports whether pod is in namespace (when non-empty)
+// and matches labelSelector.
+func podMatchesSelector(pod *v1.Pod, namespace string, labelSelector labels.Selector) bool {
+	if namespace != "" && pod.Namespace != namespace {
+		return false
+	}
+
+	return labelSelector.Matches(labels.Set(pod.Labels))
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may not use
+this file except in compliance with the License. You may obtain a copy of the
+License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed
+under the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR
+CONDITIONS OF ANY KIND, either express or implied. See the License for the
+specific language governing permissions and limitations under the License.
+*/
+
+package bpfmanagent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	bpfmaniov1alpha1 "github.com/bpfman/bpfman/bpfman-operator/apis/v1alpha1"
+)
+
+// waitFor polls cond until it reports true or timeout elapses, failing the
+// test otherwise.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("condition not met within %s", timeout)
+}
+
+func TestPodInformerEnqueuesOnPhaseTransitionAndDeletion(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	pi := newPodInformer(clientset, "node-1", testLogger(t))
+
+	owner := types.NamespacedName{Namespace: "ns", Name: "bpfprogram-1"}
+	pi.RegisterSelector(owner, &bpfmaniov1alpha1.ContainerSelector{
+		Pods: metav1.LabelSelector{MatchLabels: map[string]string{"app": "demo"}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := pi.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo-pod", Namespace: "ns", Labels: map[string]string{"app": "demo"}},
+		Spec:       v1.PodSpec{NodeName: "node-1"},
+		Status:     v1.PodStatus{Phase: v1.PodPending},
+	}
+
+	if _, err := clientset.CoreV1().Pods("ns").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		return len(pi.informer.GetStore().List()) == 1
+	})
+
+	// Updates that don't change phase (e.g. the pod gaining a new label)
+	// shouldn't enqueue a reconcile.
+	noPhaseChange := pod.DeepCopy()
+	noPhaseChange.Labels["unrelated"] = "true"
+	if _, err := clientset.CoreV1().Pods("ns").Update(ctx, noPhaseChange, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	select {
+	case ev := <-pi.Events():
+		t.Fatalf("expected no event for a non-phase-transition update, got %+v", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// A transition to Running should enqueue a reconcile for the
+	// registered owner.
+	running := noPhaseChange.DeepCopy()
+	running.Status.Phase = v1.PodRunning
+	if _, err := clientset.CoreV1().Pods("ns").Update(ctx, running, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	select {
+	case ev := <-pi.Events():
+		obj, ok := ev.Object.(*bpfmaniov1alpha1.BpfProgram)
+		if !ok || obj.Name != owner.Name || obj.Namespace != owner.Namespace {
+			t.Fatalf("unexpected event object: %+v", ev.Object)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an event after the pod transitioned to Running")
+	}
+
+	// Deleting the pod should also enqueue a reconcile.
+	if err := clientset.CoreV1().Pods("ns").Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	select {
+	case <-pi.Events():
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected an event after pod deletion")
+	}
+}
+
+func TestPodInformerHandlePodDoesNotBlockOnFullEventChannel(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	pi := newPodInformer(clientset, "node-1", testLogger(t))
+	pi.RegisterSelector(types.NamespacedName{Name: "owner"}, &bpfmaniov1alpha1.ContainerSelector{})
+
+	// Fill the event channel so a blocking send would hang forever.
+	for i := 0; i < cap(pi.events); i++ {
+		pi.events <- event.GenericEvent{}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pi.handlePod(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "extra-pod"}})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handlePod blocked sending to a full event channel")
+	}
+}